@@ -1,72 +1,470 @@
 package notifications
 
 import (
+	"errors"
+	"math/rand"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
-	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/Sirupsen/logrus"
 	grpcClient "github.com/docker/distribution/notifications/grpc"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// GRPCConfig carries the subset of an endpoint's configuration that the
+// gRPC sink needs: TLS material, a bearer token for per-RPC credentials,
+// backoff bounds for reconnection, and a directory to spool un-acked
+// events in across restarts. It is shaped to be populated from the same
+// notifications.Endpoint block used to configure the HTTP sinks, but no
+// such wiring exists in this tree: no Endpoint/listener construction code
+// calls newGrpcSink anywhere here, so GRPCConfig is only ever built
+// directly by callers (and by grpc_test.go) for now.
+type GRPCConfig struct {
+	// TLSCertFile, TLSKeyFile and TLSCAFile configure mutual TLS to the
+	// notification receiver. If all are empty, the connection is made
+	// without transport security.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+
+	// BearerToken is sent as per-RPC credentials on every call, if set.
+	BearerToken string
+
+	// BackoffMin and BackoffMax bound the exponential backoff used between
+	// reconnect attempts. They default to 1s and 30s respectively.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+
+	// SpoolDir, if set, is where un-acked events are persisted so they
+	// survive a registry restart. If empty, spooling is in-memory only.
+	SpoolDir string
+}
+
+func (cfg GRPCConfig) backoffMin() time.Duration {
+	if cfg.BackoffMin <= 0 {
+		return time.Second
+	}
+	return cfg.BackoffMin
+}
+
+func (cfg GRPCConfig) backoffMax() time.Duration {
+	if cfg.BackoffMax <= 0 {
+		return 30 * time.Second
+	}
+	return cfg.BackoffMax
+}
+
+// grpcSinkMetrics holds the real prometheus.Counter instances for a
+// grpcSink. Nothing in this tree registers them with a Prometheus registry,
+// and they are reachable only through grpcSink's unexported metrics field;
+// see newGRPCSinkMetrics.
+type grpcSinkMetrics struct {
+	sent    prometheus.Counter
+	acked   prometheus.Counter
+	dropped prometheus.Counter
+	retried prometheus.Counter
+}
+
+// grpcSink is a Sink that delivers events to a gRPC notification receiver
+// over a long-lived, bidirectional PublishStream. Events are written to
+// the stream and are not considered delivered until the matching Ack is
+// read back; un-acked events are kept in a spool and re-sent after a
+// reconnect.
 type grpcSink struct {
 	url string
+	cfg GRPCConfig
+
+	metrics grpcSinkMetrics
+
+	mu      sync.Mutex
+	closed  bool
+	closeCh chan struct{}
+
+	spool *eventSpool
 
-	mu     sync.Mutex
-	closed bool
-	client grpcClient.EventReceiverClient
 	conn   *grpc.ClientConn
+	stream grpcClient.EventReceiver_PublishStreamClient
+
+	pendingMu sync.Mutex
+	pending   map[string]chan error
 }
 
-func newGrpcSink(url string) *grpcSink {
-	conn, err := grpc.Dial(url)
+func newGrpcSink(url string, cfg GRPCConfig) (*grpcSink, error) {
+	spool, err := newEventSpool(cfg.SpoolDir)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	g := &grpcSink{
+		url:     url,
+		cfg:     cfg,
+		metrics: newGRPCSinkMetrics(url),
+		closeCh: make(chan struct{}),
+		spool:   spool,
+		pending: make(map[string]chan error),
+	}
+
+	if err := g.connect(); err != nil {
+		// The sink still starts up: the reconnect loop below will keep
+		// trying, and Write can spool events until a connection succeeds.
+		logrus.Errorf("grpcSink: initial connect to %v failed, will retry: %v", url, err)
+	}
+
+	go g.run()
+
+	return g, nil
+}
+
+// dialOptions builds the grpc.DialOptions implied by cfg: transport
+// credentials from the configured TLS material (or insecure, if none is
+// set) plus per-RPC bearer credentials. A BearerToken without TLS material
+// is rejected outright, rather than silently sent in the clear: grpc would
+// also refuse this combination (bearerCredentials.RequireTransportSecurity
+// returns true), but failing here gives a much clearer error at startup
+// instead of at the first call.
+func (g *grpcSink) dialOptions() ([]grpc.DialOption, error) {
+	tlsConfigured := g.cfg.TLSCertFile != "" || g.cfg.TLSKeyFile != "" || g.cfg.TLSCAFile != ""
+
+	if g.cfg.BearerToken != "" && !tlsConfigured {
+		return nil, errors.New("notifications: BearerToken requires TLS to be configured (TLSCertFile/TLSKeyFile/TLSCAFile)")
+	}
+
+	var opts []grpc.DialOption
+
+	if tlsConfigured {
+		creds, err := newClientTLSCredentials(g.cfg.TLSCertFile, g.cfg.TLSKeyFile, g.cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
 	}
+
+	if g.cfg.BearerToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerCredentials{token: g.cfg.BearerToken}))
+	}
+
+	return opts, nil
+}
+
+// bearerCredentials implements credentials.PerRPCCredentials, attaching a
+// static bearer token to every RPC.
+type bearerCredentials struct {
+	token string
+}
+
+func (b bearerCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + b.token}, nil
+}
+
+// RequireTransportSecurity reports true so that grpc itself refuses to
+// attach this bearer token over a connection that isn't encrypted,
+// matching the same reasoning as google.golang.org/grpc/credentials/oauth.
+func (b bearerCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// connect dials the receiver and opens the PublishStream. Any existing
+// connection is torn down first. The dial itself happens without g.mu
+// held (it can take a while), so connect re-checks g.closed once it has
+// something to publish: if Close ran in the meantime, the freshly dialed
+// conn/stream are torn down here instead of being handed to g.conn/g.stream,
+// where nothing would ever close them again.
+func (g *grpcSink) connect() error {
+	g.mu.Lock()
+
+	if g.closed {
+		g.mu.Unlock()
+		return ErrSinkClosed
+	}
+
+	if g.conn != nil {
+		g.conn.Close()
+	}
+
+	opts, err := g.dialOptions()
+	if err != nil {
+		g.mu.Unlock()
+		return err
+	}
+
+	g.mu.Unlock()
+
+	conn, err := grpc.Dial(g.url, opts...)
+	if err != nil {
+		return err
+	}
+
 	client := grpcClient.NewEventReceiverClient(conn)
-	return &grpcSink{
-		url:    url,
-		client: client,
-		conn:   conn,
-	}
-}
-
-func (g *grpcSink) Write(e ...Event) error {
-	events := make([]*grpcClient.Event, 0, len(e))
-	for _, ev := range e {
-		events = append(events, &grpcClient.Event{
-			ID:        ev.ID,
-			Timestamp: ev.Timestamp.Unix(),
-			Action:    ev.Action,
-			Target: &grpcClient.TargetMessage{
-				Repository: ev.Target.Repository,
-				URL:        ev.Target.URL,
-				Descriptor_: &grpcClient.DescriptorMessage{
-					MediaType: ev.Target.Descriptor.MediaType,
-					Length:    ev.Target.Descriptor.Length,
-					Digest:    ev.Target.Descriptor.Digest.String(),
-				},
-			},
-			Request: &grpcClient.RequestRecordMessage{
-				ID:        ev.Request.ID,
-				Addr:      ev.Request.Addr,
-				Host:      ev.Request.Host,
-				Method:    ev.Request.Method,
-				UserAgent: ev.Request.UserAgent,
-			},
-			Actor: &grpcClient.ActorRecordMessage{
-				Name: ev.Actor.Name,
-			},
-			Source: &grpcClient.SourceRecordMessage{
-				Addr:       ev.Source.Addr,
-				InstanceID: ev.Source.InstanceID,
-			},
-		})
+	stream, err := client.PublishStream(context.Background())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		conn.Close()
+		return ErrSinkClosed
 	}
-	_, err := g.client.Publish(context.Background(), &grpcClient.Events{Events: events})
-	return err
+
+	g.conn = conn
+	g.stream = stream
+
+	go g.recvLoop(stream)
+	go g.resendPending()
+
+	return nil
+}
+
+// nextBackoff doubles current, clamped to [min, max]. Split out from run
+// so the reconnect growth/clamping logic can be tested without a real
+// network connection.
+func nextBackoff(current, min, max time.Duration) time.Duration {
+	next := current * 2
+	if next > max {
+		next = max
+	}
+	if next < min {
+		next = min
+	}
+	return next
+}
+
+// run is the reconnect loop: it watches for stream failures and
+// reconnects with exponential backoff until the sink is closed.
+func (g *grpcSink) run() {
+	backoff := g.cfg.backoffMin()
+
+	for {
+		select {
+		case <-g.closeCh:
+			return
+		case <-g.streamDone():
+			if err := g.connect(); err != nil {
+				logrus.Errorf("grpcSink: reconnect to %v failed: %v", g.url, err)
+				select {
+				case <-time.After(jitter(backoff)):
+				case <-g.closeCh:
+					return
+				}
+				backoff = nextBackoff(backoff, g.cfg.backoffMin(), g.cfg.backoffMax())
+				continue
+			}
+			backoff = g.cfg.backoffMin()
+		}
+	}
+}
+
+// streamDone returns a channel that is closed once the current stream's
+// context is done (the stream has ended or errored), or at once if there is
+// no current stream. Split out mainly so run's select reads cleanly.
+func (g *grpcSink) streamDone() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		g.mu.Lock()
+		stream := g.stream
+		g.mu.Unlock()
+
+		if stream == nil {
+			close(done)
+			return
+		}
+
+		// Block until the receive loop observes an error on this stream.
+		<-stream.Context().Done()
+		close(done)
+	}()
+	return done
+}
+
+// recvLoop reads Acks off the stream and wakes up the corresponding
+// pending Write call. It returns when the stream errors, which triggers a
+// reconnect via run's streamDone select.
+func (g *grpcSink) recvLoop(stream grpcClient.EventReceiver_PublishStreamClient) {
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			return
+		}
+
+		g.handleAck(ack.ID)
+	}
+}
+
+// handleAck removes id from the spool and, if a Write call on this process
+// is blocked waiting on it, wakes it up. An event recovered from the
+// on-disk spool at startup has no waiter in pending -- it was sent by
+// resendPending, not Write -- but must still be removed from the spool
+// once acked, or it would be resent forever on every later reconnect.
+func (g *grpcSink) handleAck(id string) {
+	g.pendingMu.Lock()
+	ch, ok := g.pending[id]
+	if ok {
+		delete(g.pending, id)
+	}
+	g.pendingMu.Unlock()
+
+	g.metrics.acked.Inc()
+	g.spool.remove(id)
+
+	if ok {
+		ch <- nil
+	}
+}
+
+// resendPending re-sends every event still in the spool over the current
+// stream. Called after every successful (re)connect so events written
+// before a reconnect are not lost.
+func (g *grpcSink) resendPending() {
+	for _, ev := range g.spool.all() {
+		g.metrics.retried.Inc()
+		g.send(ev)
+	}
+}
+
+// send writes a single event to the current stream, if any. It does not
+// wait for the Ack; callers that need to block for delivery do so via the
+// pending channel registered in Write.
+func (g *grpcSink) send(ev *grpcClient.Event) {
+	g.mu.Lock()
+	stream := g.stream
+	g.mu.Unlock()
+
+	if stream == nil {
+		return
+	}
+
+	if err := stream.Send(ev); err != nil {
+		logrus.Errorf("grpcSink: send of event %v failed: %v", ev.ID, err)
+	}
+}
+
+// Write sends events to the receiver and blocks until each has been
+// acknowledged or the sink is closed. Events are spooled before being
+// sent so that a reconnect (or, with SpoolDir set, a crash) between send
+// and ack does not lose them: the spool is only cleared once the Ack for an
+// event arrives.
+func (g *grpcSink) Write(events ...Event) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrSinkClosed
+	}
+	g.mu.Unlock()
+
+	waiters := make([]chan error, 0, len(events))
+
+	for _, e := range events {
+		ev := toGRPCEvent(e)
+
+		ch := make(chan error, 1)
+		g.pendingMu.Lock()
+		g.pending[ev.ID] = ch
+		g.pendingMu.Unlock()
+
+		g.spool.add(ev)
+		g.metrics.sent.Inc()
+		g.send(ev)
+
+		waiters = append(waiters, ch)
+	}
+
+	var firstErr error
+	for _, ch := range waiters {
+		select {
+		case err := <-ch:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-g.closeCh:
+			if firstErr == nil {
+				firstErr = ErrSinkClosed
+			}
+		}
+	}
+
+	return firstErr
 }
 
 func (g *grpcSink) Close() error {
-	return g.conn.Close()
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	// Close conn here, under the same lock that guards g.closed, so that
+	// a connect() which is about to publish a new conn/stream is forced
+	// to observe g.closed and tear them down itself instead of racing
+	// this Close past the only conn it knows about.
+	conn := g.conn
+	g.conn = nil
+	g.stream = nil
+	var closeErr error
+	if conn != nil {
+		closeErr = conn.Close()
+	}
+	g.mu.Unlock()
+
+	close(g.closeCh)
+
+	// Any event still waiting on an Ack at this point never will be: count
+	// it as dropped rather than leaving the counter permanently at zero.
+	g.pendingMu.Lock()
+	for range g.pending {
+		g.metrics.dropped.Inc()
+	}
+	g.pendingMu.Unlock()
+
+	return closeErr
+}
+
+func toGRPCEvent(ev Event) *grpcClient.Event {
+	return &grpcClient.Event{
+		ID:        ev.ID,
+		Timestamp: ev.Timestamp.Unix(),
+		Action:    ev.Action,
+		Target: &grpcClient.TargetMessage{
+			Repository: ev.Target.Repository,
+			URL:        ev.Target.URL,
+			Descriptor_: &grpcClient.DescriptorMessage{
+				MediaType: ev.Target.Descriptor.MediaType,
+				Length:    ev.Target.Descriptor.Length,
+				Digest:    ev.Target.Descriptor.Digest.String(),
+			},
+		},
+		Request: &grpcClient.RequestRecordMessage{
+			ID:        ev.Request.ID,
+			Addr:      ev.Request.Addr,
+			Host:      ev.Request.Host,
+			Method:    ev.Request.Method,
+			UserAgent: ev.Request.UserAgent,
+		},
+		Actor: &grpcClient.ActorRecordMessage{
+			Name: ev.Actor.Name,
+		},
+		Source: &grpcClient.SourceRecordMessage{
+			Addr:       ev.Source.Addr,
+			InstanceID: ev.Source.InstanceID,
+		},
+	}
+}
+
+// jitter returns d plus or minus 20%, so that many sinks backing off at
+// once do not all reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	delta := float64(d) * 0.2
+	return d - time.Duration(delta) + time.Duration(rand.Float64()*2*delta)
+}
+
+func newClientTLSCredentials(certFile, keyFile, caFile string) (credentials.TransportCredentials, error) {
+	return loadTLSCredentials(certFile, keyFile, caFile)
 }
@@ -0,0 +1,164 @@
+package notifications
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/credentials"
+
+	grpcClient "github.com/docker/distribution/notifications/grpc"
+)
+
+// ErrSinkClosed is returned by Write when called on a sink that has
+// already been closed.
+var ErrSinkClosed = errors.New("notifications: sink closed")
+
+// newGRPCSinkMetrics builds the four real prometheus.Counter instances for
+// a grpcSink talking to url. They are plain prometheus.Counter values, so
+// they can be registered with prometheus.MustRegister (or any custom
+// Registerer) wherever the process wires up its metrics endpoint; this
+// package does not register them itself, since it does not own the global
+// registry.
+func newGRPCSinkMetrics(url string) grpcSinkMetrics {
+	labels := prometheus.Labels{"endpoint": url}
+
+	newCounter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   "registry",
+			Subsystem:   "notifications_grpc",
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		})
+	}
+
+	return grpcSinkMetrics{
+		sent:    newCounter("events_sent_total", "Total events sent to the gRPC notification receiver."),
+		acked:   newCounter("events_acked_total", "Total events acknowledged by the gRPC notification receiver."),
+		dropped: newCounter("events_dropped_total", "Total events closed out without ever being acknowledged."),
+		retried: newCounter("events_retried_total", "Total events resent to the receiver after a reconnect."),
+	}
+}
+
+func loadTLSCredentials(certFile, keyFile, caFile string) (credentials.TransportCredentials, error) {
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("notifications: unable to parse CA certificate " + caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// eventSpool tracks events that have been sent but not yet acked. When
+// configured with a directory, each event is also mirrored to disk so it
+// survives a registry restart; otherwise the spool is in-memory only and
+// un-acked events are lost across restarts (only across reconnects within
+// the same process, which is the common case, are they preserved).
+type eventSpool struct {
+	dir string
+
+	mu     sync.Mutex
+	events map[string]*grpcClient.Event
+}
+
+func newEventSpool(dir string) (*eventSpool, error) {
+	s := &eventSpool{
+		dir:    dir,
+		events: make(map[string]*grpcClient.Event),
+	}
+
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			continue // best-effort recovery; a missing event is simply not retried
+		}
+
+		var ev grpcClient.Event
+		if err := json.Unmarshal(data, &ev); err != nil {
+			continue
+		}
+
+		s.events[ev.ID] = &ev
+	}
+
+	return s, nil
+}
+
+func (s *eventSpool) add(ev *grpcClient.Event) {
+	s.mu.Lock()
+	s.events[ev.ID] = ev
+	s.mu.Unlock()
+
+	if s.dir == "" {
+		return
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	// Best-effort: a failure to spool to disk only matters if the process
+	// also crashes before the event is acked, which is rare enough that we
+	// do not want it to fail the write itself.
+	ioutil.WriteFile(filepath.Join(s.dir, ev.ID), data, 0600)
+}
+
+func (s *eventSpool) remove(id string) {
+	s.mu.Lock()
+	delete(s.events, id)
+	s.mu.Unlock()
+
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, id))
+	}
+}
+
+func (s *eventSpool) all() []*grpcClient.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]*grpcClient.Event, 0, len(s.events))
+	for _, ev := range s.events {
+		out = append(out, ev)
+	}
+	return out
+}
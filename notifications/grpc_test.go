@@ -0,0 +1,284 @@
+package notifications
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	grpcClient "github.com/docker/distribution/notifications/grpc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestGrpcSink() *grpcSink {
+	return &grpcSink{
+		metrics: newGRPCSinkMetrics("test"),
+		pending: make(map[string]chan error),
+	}
+}
+
+// TestGrpcSinkHandleAckRemovesRecoveredSpoolEntry covers the case of an
+// event that was recovered from the on-disk spool at startup (so it has no
+// waiter registered in pending, unlike one sent via Write): its Ack must
+// still remove it from the spool, or resendPending will keep resending it
+// on every future reconnect.
+func TestGrpcSinkHandleAckRemovesRecoveredSpoolEntry(t *testing.T) {
+	spool, err := newEventSpool("")
+	if err != nil {
+		t.Fatalf("newEventSpool: %v", err)
+	}
+
+	const id = "recovered-event"
+	spool.add(&grpcClient.Event{ID: id})
+
+	g := newTestGrpcSink()
+	g.spool = spool
+
+	g.handleAck(id)
+
+	for _, ev := range spool.all() {
+		if ev.ID == id {
+			t.Fatalf("event %q still in spool after its Ack was handled", id)
+		}
+	}
+
+	if got := testutil.ToFloat64(g.metrics.acked); got != 1 {
+		t.Fatalf("acked counter = %v, want 1", got)
+	}
+}
+
+// TestGrpcSinkHandleAckWakesPendingWriter covers the ordinary case of an
+// event sent via Write: its Ack must both clear the spool entry and wake
+// the waiter blocked on it.
+func TestGrpcSinkHandleAckWakesPendingWriter(t *testing.T) {
+	spool, err := newEventSpool("")
+	if err != nil {
+		t.Fatalf("newEventSpool: %v", err)
+	}
+
+	const id = "written-event"
+	spool.add(&grpcClient.Event{ID: id})
+
+	ch := make(chan error, 1)
+	g := newTestGrpcSink()
+	g.spool = spool
+	g.pending[id] = ch
+
+	g.handleAck(id)
+
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("unexpected error on waiter channel: %v", err)
+		}
+	default:
+		t.Fatal("waiter channel was not signaled")
+	}
+
+	for _, ev := range spool.all() {
+		if ev.ID == id {
+			t.Fatalf("event %q still in spool after its Ack was handled", id)
+		}
+	}
+}
+
+// TestGrpcSinkCloseCountsUnackedAsDropped covers the "dropped" counter:
+// any event still awaiting an Ack when the sink is closed should be
+// counted, not silently left out of the metric.
+func TestGrpcSinkCloseCountsUnackedAsDropped(t *testing.T) {
+	g := newTestGrpcSink()
+	g.closeCh = make(chan struct{})
+	g.pending["never-acked-1"] = make(chan error, 1)
+	g.pending["never-acked-2"] = make(chan error, 1)
+
+	if err := g.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := testutil.ToFloat64(g.metrics.dropped); got != 2 {
+		t.Fatalf("dropped counter = %v, want 2", got)
+	}
+}
+
+// TestGrpcSinkConnectBailsOutWhenClosed covers the shutdown race: if Close
+// has already run by the time connect is about to dial, connect must not
+// go on to publish a conn/stream that nothing will ever tear down.
+func TestGrpcSinkConnectBailsOutWhenClosed(t *testing.T) {
+	g := newTestGrpcSink()
+	g.closeCh = make(chan struct{})
+	g.closed = true
+
+	if err := g.connect(); err != ErrSinkClosed {
+		t.Fatalf("connect() error = %v, want ErrSinkClosed", err)
+	}
+
+	if g.conn != nil || g.stream != nil {
+		t.Fatalf("connect() published a conn/stream on a closed sink")
+	}
+}
+
+// TestNextBackoff covers the reconnect loop's backoff growth and clamping,
+// independent of any real network connection.
+func TestNextBackoff(t *testing.T) {
+	min := time.Second
+	max := 30 * time.Second
+
+	cases := []struct {
+		current time.Duration
+		want    time.Duration
+	}{
+		{current: min, want: 2 * time.Second},
+		{current: 2 * time.Second, want: 4 * time.Second},
+		{current: 20 * time.Second, want: max}, // 40s doubled, clamped to max
+		{current: max, want: max},              // already at the ceiling
+	}
+
+	for _, c := range cases {
+		if got := nextBackoff(c.current, min, max); got != c.want {
+			t.Errorf("nextBackoff(%v, %v, %v) = %v, want %v", c.current, min, max, got, c.want)
+		}
+	}
+}
+
+// TestJitterStaysWithinBounds covers that jitter never pushes a duration
+// outside +/-20% of its input, so a misbehaving jitter can't turn a bounded
+// backoff into an unbounded one.
+func TestJitterStaysWithinBounds(t *testing.T) {
+	d := 10 * time.Second
+	low := d - d/5
+	high := d + d/5
+
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < low || got > high {
+			t.Fatalf("jitter(%v) = %v, want within [%v, %v]", d, got, low, high)
+		}
+	}
+}
+
+// TestDialOptionsRejectsBearerTokenWithoutTLS covers the fix for sending a
+// bearer token in the clear: BearerToken without any TLS material
+// configured must fail fast in dialOptions rather than dial insecurely.
+func TestDialOptionsRejectsBearerTokenWithoutTLS(t *testing.T) {
+	g := &grpcSink{cfg: GRPCConfig{BearerToken: "secret"}}
+
+	if _, err := g.dialOptions(); err == nil {
+		t.Fatal("dialOptions succeeded with a BearerToken and no TLS configured, want an error")
+	}
+}
+
+// TestDialOptionsInsecureWithoutConfig covers the plain case: no TLS, no
+// bearer token, dialOptions should succeed and not require credentials.
+func TestDialOptionsInsecureWithoutConfig(t *testing.T) {
+	g := &grpcSink{}
+
+	opts, err := g.dialOptions()
+	if err != nil {
+		t.Fatalf("dialOptions: %v", err)
+	}
+	if len(opts) != 1 {
+		t.Fatalf("dialOptions returned %d options, want 1 (insecure only)", len(opts))
+	}
+}
+
+// TestDialOptionsWithTLSAndBearerToken covers the success path: valid TLS
+// material plus a bearer token should both be applied without error.
+func TestDialOptionsWithTLSAndBearerToken(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertKeyPair(t, dir)
+
+	g := &grpcSink{cfg: GRPCConfig{
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		BearerToken: "secret",
+	}}
+
+	opts, err := g.dialOptions()
+	if err != nil {
+		t.Fatalf("dialOptions: %v", err)
+	}
+	if len(opts) != 2 {
+		t.Fatalf("dialOptions returned %d options, want 2 (transport creds + per-RPC creds)", len(opts))
+	}
+}
+
+// TestBearerCredentialsRequireTransportSecurity covers the fix itself:
+// bearerCredentials must require transport security so grpc refuses to
+// send it over a cleartext connection.
+func TestBearerCredentialsRequireTransportSecurity(t *testing.T) {
+	if !(bearerCredentials{token: "secret"}).RequireTransportSecurity() {
+		t.Fatal("bearerCredentials.RequireTransportSecurity() = false, want true")
+	}
+}
+
+// TestLoadTLSCredentials covers the success path of loading a certificate
+// and key pair into transport credentials.
+func TestLoadTLSCredentials(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertKeyPair(t, dir)
+
+	if _, err := loadTLSCredentials(certFile, keyFile, ""); err != nil {
+		t.Fatalf("loadTLSCredentials: %v", err)
+	}
+}
+
+// writeTestCertKeyPair generates a throwaway self-signed certificate and
+// key pair for TLS-loading tests and returns their paths under dir.
+func writeTestCertKeyPair(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grpc-sink-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		t.Fatalf("create cert file: %v", err)
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatalf("encode cert: %v", err)
+	}
+
+	keyOut, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatalf("create key file: %v", err)
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
+		t.Fatalf("encode key: %v", err)
+	}
+
+	// Sanity check the pair actually loads as a tls.Certificate before
+	// handing it to the test that exercises loadTLSCredentials/dialOptions.
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatalf("generated test cert/key pair does not load: %v", err)
+	}
+
+	return certFile, keyFile
+}
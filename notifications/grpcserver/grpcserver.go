@@ -0,0 +1,47 @@
+// Package grpcserver provides a helper for implementing the server side of
+// the gRPC notification ack protocol used by the registry's grpcSink. A
+// consumer of notification events embeds AckStreamServer in its own
+// EventReceiverServer implementation to get correct, ordered Ack replies
+// without having to re-derive the protocol from the client.
+package grpcserver
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	grpcClient "github.com/docker/distribution/notifications/grpc"
+)
+
+// EventHandlerFunc processes a single event received over the stream. A
+// non-nil error causes the corresponding Ack to be skipped, so the client
+// will retry the event on its next reconnect.
+type EventHandlerFunc func(*grpcClient.Event) error
+
+// AckStreamServer implements the receive/process/ack loop for a
+// PublishStream call. Embed it in a concrete EventReceiverServer and
+// forward the PublishStream method to Serve:
+//
+//	func (s *myServer) PublishStream(stream grpcClient.EventReceiver_PublishStreamServer) error {
+//		return s.AckStreamServer.Serve(stream, s.handleEvent)
+//	}
+type AckStreamServer struct{}
+
+// Serve reads events off stream until it errors or the client closes its
+// send direction, invoking handle for each one and replying with an Ack
+// as long as handle returns nil. It blocks for the life of the stream.
+func (AckStreamServer) Serve(stream grpcClient.EventReceiver_PublishStreamServer, handle EventHandlerFunc) error {
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if err := handle(ev); err != nil {
+			logrus.Errorf("grpcserver: dropping event %v: %v", ev.ID, err)
+			continue
+		}
+
+		if err := stream.Send(&grpcClient.Ack{ID: ev.ID}); err != nil {
+			return err
+		}
+	}
+}